@@ -0,0 +1,41 @@
+package binarycache
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FileStore is a Store backed by a local directory laid out like a binary
+// cache, e.g. a Nix store mounted or rsynced to disk.
+type FileStore struct {
+	Root string
+}
+
+// NewFileStore returns a Store rooted at dir.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{Root: dir}
+}
+
+func (s *FileStore) Name() string {
+	return "file://" + s.Root
+}
+
+func (s *FileStore) GetNarInfo(hash string) (*NarInfo, error) {
+	raw, err := os.ReadFile(filepath.Join(s.Root, hash+".narinfo"))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseNarInfo(string(raw))
+}
+
+func (s *FileStore) GetNar(relPath string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.Root, relPath))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
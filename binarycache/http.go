@@ -0,0 +1,106 @@
+package binarycache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/notashelf/grep-nixos-cache/cache"
+)
+
+// HTTPStore is a Store backed by an HTTP(S) Nix binary cache, such as
+// cache.nixos.org, Cachix, or a private Hydra cache.
+type HTTPStore struct {
+	BaseURL string
+	Client  *http.Client
+
+	// Cache, if set, is consulted before re-fetching a narinfo already seen
+	// from this store.
+	Cache *cache.FileCache
+}
+
+// NewHTTPStore returns a Store for the binary cache rooted at baseURL, e.g.
+// "https://cache.nixos.org". fc may be nil to disable narinfo caching.
+func NewHTTPStore(baseURL string, fc *cache.FileCache) *HTTPStore {
+	return &HTTPStore{BaseURL: baseURL, Client: http.DefaultClient, Cache: fc}
+}
+
+func (s *HTTPStore) Name() string {
+	return s.BaseURL
+}
+
+func (s *HTTPStore) GetNarInfo(hash string) (*NarInfo, error) {
+	fetch := func() ([]byte, error) {
+		narInfoURL := fmt.Sprintf("%s/%s.narinfo", s.BaseURL, hash)
+
+		resp, err := s.Client.Get(narInfoURL)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden {
+			return nil, ErrNotFound
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: unexpected status %s", narInfoURL, resp.Status)
+		}
+
+		return io.ReadAll(resp.Body)
+	}
+
+	var body []byte
+	var err error
+	if s.Cache != nil {
+		body, err = s.Cache.FetchBytes(cache.Key("narinfo", s.Name(), hash), fetch)
+	} else {
+		body, err = fetch()
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseNarInfo(string(body))
+}
+
+// GetNar resolves narURL against BaseURL (narinfo `URL:` fields are
+// typically relative, e.g. "nar/1a2b3c....nar.xz") and fetches it.
+func (s *HTTPStore) GetNar(narURL string) (io.ReadCloser, error) {
+	resolved, err := s.resolve(narURL)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.Client.Get(resolved)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s: unexpected status %s", resolved, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+func (s *HTTPStore) resolve(narURL string) (string, error) {
+	base, err := url.Parse(s.BaseURL + "/")
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(narURL)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
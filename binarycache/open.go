@@ -0,0 +1,46 @@
+package binarycache
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/notashelf/grep-nixos-cache/cache"
+)
+
+// DefaultCDNSubstituter and DefaultS3Substituter describe cache.nixos.org,
+// the only substituter used when the caller passes none explicitly.
+const (
+	DefaultCDNSubstituter = "https://cache.nixos.org"
+	DefaultS3Substituter  = "s3://nix-cache"
+)
+
+// Open resolves a substituter URL, in the same style as Nix's
+// `substituters` setting, to a Store. Recognized schemes are http(s)://,
+// s3://bucket[?region=...], and file:///path. s3Region is used as the
+// fallback region for s3:// substituters that don't specify one in their
+// query string. fc, if non-nil, is used to cache narinfo lookups against
+// network-backed substituters.
+func Open(substituter, s3Region string, fc *cache.FileCache) (Store, error) {
+	switch {
+	case strings.HasPrefix(substituter, "file://"):
+		return NewFileStore(strings.TrimPrefix(substituter, "file://")), nil
+
+	case strings.HasPrefix(substituter, "s3://"):
+		u, err := url.Parse(substituter)
+		if err != nil {
+			return nil, fmt.Errorf("parsing substituter %q: %w", substituter, err)
+		}
+		region := u.Query().Get("region")
+		if region == "" {
+			region = s3Region
+		}
+		return NewS3Store(u.Host, region, fc)
+
+	case strings.HasPrefix(substituter, "http://"), strings.HasPrefix(substituter, "https://"):
+		return NewHTTPStore(strings.TrimSuffix(substituter, "/"), fc), nil
+
+	default:
+		return nil, fmt.Errorf("unrecognized substituter %q: must start with http://, https://, s3://, or file://", substituter)
+	}
+}
@@ -0,0 +1,81 @@
+package binarycache
+
+import (
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/notashelf/grep-nixos-cache/cache"
+)
+
+// S3Store is a Store backed by a direct S3 bucket, e.g. the bucket backing
+// cache.nixos.org or a private binary cache.
+type S3Store struct {
+	Bucket string
+	Region string
+
+	// Cache, if set, is consulted before re-fetching a narinfo already seen
+	// from this store.
+	Cache *cache.FileCache
+
+	client *s3.S3
+}
+
+// NewS3Store returns a Store for the given S3 bucket and region. fc may be
+// nil to disable narinfo caching.
+func NewS3Store(bucket, region string, fc *cache.FileCache) (*S3Store, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
+	return &S3Store{Bucket: bucket, Region: region, Cache: fc, client: s3.New(sess)}, nil
+}
+
+func (s *S3Store) Name() string {
+	return "s3://" + s.Bucket
+}
+
+func (s *S3Store) GetNarInfo(hash string) (*NarInfo, error) {
+	fetch := func() ([]byte, error) {
+		body, err := s.getObject(hash + ".narinfo")
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+		return io.ReadAll(body)
+	}
+
+	var raw []byte
+	var err error
+	if s.Cache != nil {
+		raw, err = s.Cache.FetchBytes(cache.Key("narinfo", s.Name(), hash), fetch)
+	} else {
+		raw, err = fetch()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseNarInfo(string(raw))
+}
+
+func (s *S3Store) GetNar(key string) (io.ReadCloser, error) {
+	return s.getObject(key)
+}
+
+func (s *S3Store) getObject(key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			if aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound" {
+				return nil, ErrNotFound
+			}
+		}
+		return nil, err
+	}
+	return out.Body, nil
+}
@@ -0,0 +1,88 @@
+// Package binarycache abstracts over Nix binary cache backends (HTTP(S)
+// caches, S3 buckets, and local filesystem caches) behind a single Store
+// interface, so callers can grep private Hydra caches, Cachix, or S3-backed
+// mirrors the same way they grep cache.nixos.org.
+package binarycache
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrNotFound is returned by a Store when the requested narinfo or NAR does
+// not exist in that store. Callers fetching from multiple substituters fall
+// through to the next store on ErrNotFound.
+var ErrNotFound = errors.New("not found in binary cache")
+
+// NarInfo holds the subset of narinfo fields this tool cares about. See
+// https://nixos.org/manual/nix/stable/protocols/nix-http-binary-cache.
+type NarInfo struct {
+	StorePath   string
+	URL         string
+	Compression string
+	FileHash    string
+	NarHash     string
+	NarSize     int64
+	References  []string
+	Sig         []string
+}
+
+// defaultCompression is Nix's own default when a narinfo omits
+// `Compression:` entirely.
+const defaultCompression = "bzip2"
+
+// ParseNarInfo parses the key/value lines of a narinfo file.
+func ParseNarInfo(raw string) (*NarInfo, error) {
+	info := &NarInfo{Compression: defaultCompression}
+	found := false
+
+	for _, line := range strings.Split(raw, "\n") {
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "StorePath":
+			info.StorePath = value
+		case "URL":
+			info.URL = value
+			found = true
+		case "Compression":
+			info.Compression = value
+		case "FileHash":
+			info.FileHash = value
+		case "NarHash":
+			info.NarHash = value
+		case "NarSize":
+			if size, err := strconv.ParseInt(value, 10, 64); err == nil {
+				info.NarSize = size
+			}
+		case "References":
+			if value != "" {
+				info.References = strings.Split(value, " ")
+			}
+		case "Sig":
+			info.Sig = append(info.Sig, value)
+		}
+	}
+
+	if !found {
+		return nil, errors.New("did not find a NAR URL key")
+	}
+	return info, nil
+}
+
+// Store is a single Nix binary cache backend.
+type Store interface {
+	// Name identifies the store for logging, e.g. its substituter URL.
+	Name() string
+	// GetNarInfo fetches and parses the narinfo for the given store path
+	// hash, returning ErrNotFound if this store has none.
+	GetNarInfo(hash string) (*NarInfo, error)
+	// GetNar opens the NAR referenced by a narinfo's URL field, as returned
+	// from a prior GetNarInfo call on the same store.
+	GetNar(url string) (io.ReadCloser, error)
+}
@@ -0,0 +1,105 @@
+package binarycache
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/nix-community/go-nix/pkg/storepath"
+)
+
+// DefaultTrustedPublicKey is cache.nixos.org's well-known signing key, the
+// same default Nix itself trusts out of the box.
+const DefaultTrustedPublicKey = "cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="
+
+// TrustedKeys maps a key name (as used in narinfo `Sig:` lines) to its
+// ed25519 public key.
+type TrustedKeys map[string]ed25519.PublicKey
+
+// ParseTrustedKeys parses keys in Nix's `trusted-public-keys` format,
+// "name:base64key", one per entry.
+func ParseTrustedKeys(raw []string) (TrustedKeys, error) {
+	keys := make(TrustedKeys, len(raw))
+	for _, entry := range raw {
+		name, encoded, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid trusted public key %q: expected name:base64key", entry)
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted public key %q: %w", entry, err)
+		}
+		if len(decoded) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid trusted public key %q: wrong key size", entry)
+		}
+
+		keys[name] = ed25519.PublicKey(decoded)
+	}
+	return keys, nil
+}
+
+// fingerprint reproduces Nix's NAR signing fingerprint: see
+// src/libstore/path-info.cc (fingerprint()) upstream. References are
+// narinfo basenames, so each must be expanded back to its full
+// /nix/store/<hash>-<name> path before joining, same as Nix's own
+// printStorePathSet(references).
+func fingerprint(info *NarInfo) string {
+	references := make([]string, len(info.References))
+	for i, ref := range info.References {
+		references[i] = storepath.StoreDir + "/" + ref
+	}
+	return fmt.Sprintf("1;%s;%s;%s;%s", info.StorePath, info.NarHash, strconv.FormatInt(info.NarSize, 10), strings.Join(references, ","))
+}
+
+// VerifySignature reports whether info carries at least one `Sig:` entry
+// that validates against keys.
+func VerifySignature(info *NarInfo, keys TrustedKeys) bool {
+	if len(info.Sig) == 0 || len(keys) == 0 {
+		return false
+	}
+
+	fp := []byte(fingerprint(info))
+	for _, sig := range info.Sig {
+		name, encoded, ok := strings.Cut(sig, ":")
+		if !ok {
+			continue
+		}
+		key, ok := keys[name]
+		if !ok {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		if ed25519.Verify(key, fp, decoded) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyNarHash reports whether sum, the sha256 digest of a downloaded NAR,
+// matches narHash, a narinfo `NarHash:` field (e.g.
+// "sha256:1w1fff338ciwb...", Nix-base32 encoded). A signature only
+// authenticates the narinfo's metadata fields, not the NAR bytes fetched
+// separately from NarInfo.URL, so callers must check this too before
+// trusting the downloaded content matches what was signed.
+func VerifyNarHash(sum []byte, narHash string) (bool, error) {
+	algo, encoded, ok := strings.Cut(narHash, ":")
+	if !ok || algo != "sha256" {
+		return false, fmt.Errorf("unsupported NarHash %q: expected sha256:<digest>", narHash)
+	}
+
+	want, err := nixbase32.DecodeString(encoded)
+	if err != nil {
+		return false, fmt.Errorf("decoding NarHash %q: %w", narHash, err)
+	}
+
+	return bytes.Equal(sum, want), nil
+}
@@ -0,0 +1,202 @@
+// Package cache provides an on-disk, size- and age-bounded cache for narinfo
+// and NAR bytes keyed by store path hash, so repeated runs against the same
+// paths don't re-download from the configured binary cache.
+package cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Forever disables age-based expiry entirely; entries are only evicted by
+// the size cap.
+const Forever time.Duration = -1
+
+// keySanitizer strips the characters that would otherwise turn a cache key
+// into a path (or query string) when joined onto Dir.
+var keySanitizer = strings.NewReplacer("/", "_", ":", "_", "?", "_", "&", "_", "=", "_")
+
+// Key joins parts into a single flat cache key safe to use as a filename,
+// e.g. Key("narinfo", store.Name(), hash) so the same hash fetched from two
+// different substituters doesn't collide in one cache directory.
+func Key(parts ...string) string {
+	safe := make([]string, len(parts))
+	for i, p := range parts {
+		safe[i] = keySanitizer.Replace(p)
+	}
+	return strings.Join(safe, "-")
+}
+
+// FileCache is a flat, per-key file cache rooted at Dir. Entries older than
+// MaxAge are treated as misses, and a successful write evicts the
+// least-recently-used entries once the cache exceeds MaxBytes.
+type FileCache struct {
+	Dir      string
+	MaxAge   time.Duration // Forever (-1) never expires, 0 disables the cache.
+	MaxBytes int64
+
+	group singleflight.Group
+}
+
+// New creates a FileCache rooted at dir, creating the directory if needed.
+func New(dir string, maxAge time.Duration, maxBytes int64) (*FileCache, error) {
+	if maxAge != 0 {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("creating cache dir: %w", err)
+		}
+	}
+	return &FileCache{Dir: dir, MaxAge: maxAge, MaxBytes: maxBytes}, nil
+}
+
+// Disabled reports whether caching is turned off entirely (MaxAge == 0).
+func (c *FileCache) Disabled() bool {
+	return c.MaxAge == 0
+}
+
+func (c *FileCache) entryPath(key string) string {
+	return filepath.Join(c.Dir, key)
+}
+
+func (c *FileCache) isFresh(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if c.MaxAge > 0 && time.Since(info.ModTime()) > c.MaxAge {
+		return false
+	}
+	return true
+}
+
+// Fetch streams the cached contents for key, calling populate to fill the
+// cache on a miss. Concurrent Fetch calls for the same key share a single
+// populate call. The returned ReadCloser must be closed by the caller.
+//
+// When the cache is disabled, populate is streamed straight through without
+// ever touching disk.
+func (c *FileCache) Fetch(key string, populate func(w io.Writer) error) (io.ReadCloser, error) {
+	if c.Disabled() {
+		pr, pw := io.Pipe()
+		go func() { pw.CloseWithError(populate(pw)) }()
+		return pr, nil
+	}
+
+	path := c.entryPath(key)
+	if c.isFresh(path) {
+		touch(path)
+		return os.Open(path)
+	}
+
+	_, err, _ := c.group.Do(key, func() (interface{}, error) {
+		if c.isFresh(path) {
+			return nil, nil
+		}
+
+		tmp := path + ".tmp"
+		f, err := os.Create(tmp)
+		if err != nil {
+			return nil, err
+		}
+
+		err = populate(f)
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return nil, err
+		}
+
+		if err := os.Rename(tmp, path); err != nil {
+			return nil, err
+		}
+		return nil, c.evict()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	touch(path)
+	return os.Open(path)
+}
+
+// FetchBytes is a convenience wrapper around Fetch for small entries (such
+// as narinfo files) where buffering the whole value is acceptable.
+func (c *FileCache) FetchBytes(key string, populate func() ([]byte, error)) ([]byte, error) {
+	rc, err := c.Fetch(key, func(w io.Writer) error {
+		data, err := populate()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func touch(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
+
+func (c *FileCache) evict() error {
+	if c.MaxBytes <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return err
+	}
+
+	type fileInfo struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var files []fileInfo
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		p := filepath.Join(c.Dir, entry.Name())
+		files = append(files, fileInfo{path: p, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+
+	if total <= c.MaxBytes {
+		return nil
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	for _, f := range files {
+		if total <= c.MaxBytes {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			continue
+		}
+		total -= f.size
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		parts []string
+		want  string
+	}{
+		{[]string{"narinfo", "hash"}, "narinfo-hash"},
+		{[]string{"narinfo", "https://cache.nixos.org", "hash"}, "narinfo-https___cache.nixos.org-hash"},
+		{[]string{"nar", "a?b=c&d"}, "nar-a_b_c_d"},
+	}
+	for _, tt := range tests {
+		if got := Key(tt.parts...); got != tt.want {
+			t.Errorf("Key(%q) = %q, want %q", tt.parts, got, tt.want)
+		}
+	}
+}
+
+func TestFetchMissThenHit(t *testing.T) {
+	c, err := New(t.TempDir(), Forever, 0)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	var populateCalls int32
+	populate := func(w io.Writer) error {
+		atomic.AddInt32(&populateCalls, 1)
+		_, err := w.Write([]byte("hello"))
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		rc, err := c.Fetch("key", populate)
+		if err != nil {
+			t.Fatalf("Fetch: %v", err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		if string(got) != "hello" {
+			t.Errorf("Fetch returned %q, want %q", got, "hello")
+		}
+	}
+
+	if populateCalls != 1 {
+		t.Errorf("populate called %d times, want 1 (second Fetch should hit the cache)", populateCalls)
+	}
+}
+
+func TestFetchDisabled(t *testing.T) {
+	c, err := New(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	var populateCalls int32
+	populate := func(w io.Writer) error {
+		atomic.AddInt32(&populateCalls, 1)
+		_, err := w.Write([]byte("hello"))
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		rc, err := c.Fetch("key", populate)
+		if err != nil {
+			t.Fatalf("Fetch: %v", err)
+		}
+		if _, err := io.ReadAll(rc); err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		rc.Close()
+	}
+
+	if populateCalls != 2 {
+		t.Errorf("populate called %d times, want 2 (a disabled cache must never skip populate)", populateCalls)
+	}
+}
+
+func TestFetchExpiresByMaxAge(t *testing.T) {
+	c, err := New(t.TempDir(), time.Millisecond, 0)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	var populateCalls int32
+	populate := func(w io.Writer) error {
+		atomic.AddInt32(&populateCalls, 1)
+		_, err := w.Write([]byte("hello"))
+		return err
+	}
+
+	rc, err := c.Fetch("key", populate)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	rc.Close()
+
+	time.Sleep(5 * time.Millisecond)
+
+	rc, err = c.Fetch("key", populate)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	rc.Close()
+
+	if populateCalls != 2 {
+		t.Errorf("populate called %d times, want 2 (entry should have expired)", populateCalls)
+	}
+}
+
+func TestFetchBytes(t *testing.T) {
+	c, err := New(t.TempDir(), Forever, 0)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	got, err := c.FetchBytes("key", func() ([]byte, error) {
+		return []byte("narinfo contents"), nil
+	})
+	if err != nil {
+		t.Fatalf("FetchBytes: %v", err)
+	}
+	if string(got) != "narinfo contents" {
+		t.Errorf("FetchBytes = %q, want %q", got, "narinfo contents")
+	}
+}
+
+func TestEvictByMaxBytes(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, Forever, 10)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	populate := func(data string) func(w io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := w.Write([]byte(data))
+			return err
+		}
+	}
+
+	// "old" is touched first, so it should be the one evicted once "new"
+	// pushes the cache over MaxBytes.
+	rc, err := c.Fetch("old", populate("0123456789"))
+	if err != nil {
+		t.Fatalf("Fetch(old): %v", err)
+	}
+	rc.Close()
+
+	rc, err = c.Fetch("new", populate("0123456789"))
+	if err != nil {
+		t.Fatalf("Fetch(new): %v", err)
+	}
+	rc.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, "old")); !os.IsNotExist(err) {
+		t.Errorf("entry %q should have been evicted, stat err = %v", "old", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new")); err != nil {
+		t.Errorf("entry %q should still be cached: %v", "new", err)
+	}
+}
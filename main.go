@@ -2,7 +2,9 @@ package main
 
 import (
 	"bufio"
+	"compress/bzip2"
 	"compress/gzip"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -11,28 +13,111 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/notashelf/grep-nixos-cache/binarycache"
+	"github.com/notashelf/grep-nixos-cache/cache"
+	"github.com/ulikunitz/xz"
 )
 
 const (
-	nixCacheS3Base  = "https://nix-cache.s3.amazonaws.com"
-	nixCacheCDNBase = "https://cache.nixos.org"
-	nixCacheRegion  = "us-east-1"
-	userAgent       = "grep-nixos-cache 1.0 (https://github.com/notashelf/grep-nixos-cache)"
+	nixCacheRegion = "us-east-1"
+	userAgent      = "grep-nixos-cache 1.0 (https://github.com/notashelf/grep-nixos-cache)"
 )
 
+// matchTarget controls what part of a NAR entry --needle is compared against.
+type matchTarget string
+
+const (
+	matchPath     matchTarget = "path"
+	matchContents matchTarget = "contents"
+	matchBoth     matchTarget = "both"
+)
+
+// workItem is a single store path queued for grepping, along with the
+// top-level input path that pulled it into the closure (itself, for
+// top-level inputs) and how many References hops away from it it is.
+type workItem struct {
+	Path  string
+	Root  string
+	Depth int
+}
+
+// stringList implements flag.Value for a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// trustedKeysFlag is a repeatable string flag that replaces its seeded
+// default on the first explicit --trusted-public-keys, rather than
+// appending to it.
+type trustedKeysFlag struct {
+	values []string
+	isSet  bool
+}
+
+func (f *trustedKeysFlag) String() string { return strings.Join(f.values, ",") }
+func (f *trustedKeysFlag) Set(v string) error {
+	if !f.isSet {
+		f.values = nil
+		f.isSet = true
+	}
+	f.values = append(f.values, v)
+	return nil
+}
+
 var (
 	needle       = flag.String("needle", "", "String to look for in the target Nix store paths.")
 	path         = flag.String("path", "", "Single Nix store path that need to be checked (mostly for testing purposes).")
 	paths        = flag.String("paths", "", "Filename containing a newline-separated list of Nix store paths that need to be checked.")
 	hydraEvalURL = flag.String("hydra_eval_url", "", "Hydra eval URL to get all output Nix store paths from.")
 	parallelism  = flag.Int("parallelism", 15, "Number of simultaneous store paths to process in flight.")
+	match        = flag.String("match", "path", "What to match --needle against: path, contents, or both.")
+
+	cacheDir     = flag.String("cache-dir", defaultCacheDir(), "Directory to cache narinfo and NAR downloads in.")
+	cacheMaxAge  = flag.Duration("cache-max-age", time.Hour, "How long cached downloads stay valid. A negative value caches forever; 0 disables the cache.")
+	cacheMaxSize = flag.Int64("cache-max-size", 1<<30, "Maximum total size in bytes of the on-disk cache before the oldest entries are evicted.")
+
+	maxFileSize = flag.Int64("max-file-size", 64<<20, "Skip file contents above this many bytes when --match includes contents (0 disables the guard).")
+
+	s3Region         = flag.String("s3-region", nixCacheRegion, "AWS region to use for s3:// substituters that don't specify one in their query string.")
+	noCheckSignature = flag.Bool("no-check-signature", false, "Grep NARs even if they carry no signature valid under --trusted-public-keys.")
+
+	closure        = flag.Bool("closure", false, "Also grep every path transitively referenced by each input path.")
+	maxDepth       = flag.Int("max-depth", 0, "Maximum reference depth to follow in --closure mode (0 = unlimited).")
+	excludePattern = flag.String("exclude-pattern", "", "Regexp; store paths matching it are not followed in --closure mode.")
+
+	substituters      stringList
+	trustedPublicKeys = trustedKeysFlag{values: []string{binarycache.DefaultTrustedPublicKey}}
 )
 
+func init() {
+	flag.Var(&substituters, "substituter", "Binary cache to grep, as a http(s)://, s3://, or file:// URL (repeatable). Defaults to cache.nixos.org.")
+	flag.Var(&trustedPublicKeys, "trusted-public-keys", "Trusted signing keys in name:base64key form (repeatable). Defaults to cache.nixos.org's key.")
+}
+
+// defaultCacheDir returns $XDG_CACHE_HOME/grep-nixos-cache (or the
+// platform-appropriate equivalent via os.UserCacheDir).
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ".grep-nixos-cache"
+	}
+	return filepath.Join(dir, "grep-nixos-cache")
+}
+
 func getAwsRegion() (string, error) {
 	sess := session.Must(session.NewSession())
 	svc := ec2metadata.New(sess)
@@ -90,65 +175,222 @@ func collectOutputPaths() ([]string, error) {
 	}
 }
 
-func fetchNarInfo(url string) (string, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", err
+// resolveStores turns --substituter into the list of binary caches to
+// consult for each store path, in order, falling back to defaultSubstituter
+// when none were given explicitly. fc is wired into each http(s):// and s3://
+// store so their narinfo lookups are cached the same way NAR downloads are;
+// file:// stores read narinfo from disk uncached.
+func resolveStores(defaultSubstituter string, fc *cache.FileCache) ([]binarycache.Store, error) {
+	subs := substituters
+	if len(subs) == 0 {
+		subs = stringList{defaultSubstituter}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusForbidden {
-		return "", nil
+	stores := make([]binarycache.Store, 0, len(subs))
+	for _, sub := range subs {
+		store, err := binarycache.Open(sub, *s3Region, fc)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, store)
 	}
+	return stores, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+// fetchNarInfo tries each store in turn, falling through to the next one on
+// ErrNotFound, and returns the narinfo together with the store that served
+// it so the matching NAR can be fetched from the same place. Network-backed
+// stores cache their own narinfo lookups (see resolveStores).
+func fetchNarInfo(stores []binarycache.Store, hash string) (*binarycache.NarInfo, binarycache.Store, error) {
+	for _, store := range stores {
+		info, err := store.GetNarInfo(hash)
+		if errors.Is(err, binarycache.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", store.Name(), err)
+		}
+		return info, store, nil
 	}
+	return nil, nil, nil
+}
 
-	for _, line := range strings.Split(string(body), "\n") {
-		if strings.HasPrefix(line, "URL: ") {
-			return strings.TrimPrefix(line, "URL: "), nil
+// decompressorFor wraps r with the decompressor matching the narinfo
+// `Compression:` field, as documented at
+// https://nixos.org/manual/nix/stable/protocols/nix-http-binary-cache.
+// The returned ReadCloser must be closed once fully read: in particular,
+// zstd decoders own worker goroutines that only stop on Close.
+func decompressorFor(compression string, r io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case "xz":
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
 		}
+		return io.NopCloser(xr), nil
+	case "bzip2":
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case "zstd":
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case "none":
+		return io.NopCloser(r), nil
+	case "gzip", "":
+		return gzip.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unsupported NAR compression %q", compression)
 	}
-	return "", errors.New("Did not find a NAR URL key")
 }
 
-func fetchNar(narURL string) ([]byte, error) {
-	resp, err := http.Get(narURL)
+// fetchNar returns the narinfo-declared compression stream, decompressed,
+// for info, fetched from store via the on-disk cache. The caller owns the
+// returned ReadCloser and must close it; doing so releases both the
+// decompressor (e.g. zstd's worker goroutines) and the underlying cache
+// file handle the NAR was streamed from.
+func fetchNar(fc *cache.FileCache, store binarycache.Store, info *binarycache.NarInfo, hash string) (io.ReadCloser, error) {
+	raw, err := fc.Fetch("nar-"+hash, func(w io.Writer) error {
+		body, err := store.GetNar(info.URL)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		_, err = io.Copy(w, body)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	var reader io.Reader
-	switch resp.Header.Get("Content-Encoding") {
-	case "gzip":
-		reader, err = gzip.NewReader(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-	default:
-		reader = resp.Body
+	decompressed, err := decompressorFor(info.Compression, raw)
+	if err != nil {
+		raw.Close()
+		return nil, err
 	}
 
-	return io.ReadAll(reader)
+	return &narStream{decompressed: decompressed, raw: raw}, nil
 }
 
-func findNeedleInNar(needle string, nar []byte) []string {
-	var filesMatched []string
-	for _, file := range strings.Split(string(nar), "\n") {
-		if strings.Contains(file, needle) {
-			filesMatched = append(filesMatched, file)
-		}
+// narStream pairs a decompressed NAR reader with the closer of the
+// underlying cache file it was streamed from, closing both on Close.
+type narStream struct {
+	decompressed io.ReadCloser
+	raw          io.Closer
+}
+
+func (s *narStream) Read(p []byte) (int, error) {
+	return s.decompressed.Read(p)
+}
+
+func (s *narStream) Close() error {
+	err := s.decompressed.Close()
+	if rawErr := s.raw.Close(); err == nil {
+		err = rawErr
 	}
-	return filesMatched
+	return err
+}
+
+// Match is a single --needle hit found while scanning a NAR.
+type Match struct {
+	// Path is the NAR entry path the match occurred in.
+	Path string
+	// Detail carries additional context for the match, such as a symlink
+	// target, when Path alone isn't the full story.
+	Detail string
+}
+
+func (m Match) String() string {
+	if m.Detail == "" {
+		return m.Path
+	}
+	return fmt.Sprintf("%s -> %s", m.Path, m.Detail)
+}
+
+// scanNar walks a decompressed NAR archive entry by entry, matching needle
+// against each entry's path, symlink target, and/or file contents as
+// selected by target, emitting matches on the returned channel as they are
+// found. Regular files larger than maxFileSize are skipped when matching
+// contents (maxFileSize <= 0 disables the guard). The channel is closed once
+// the NAR has been fully consumed or an error occurs; scan errors are
+// logged, not returned, since the channel has already been handed to the
+// caller.
+func scanNar(r io.Reader, needle string, target matchTarget, maxFileSize int64) <-chan Match {
+	out := make(chan Match)
+
+	go func() {
+		defer close(out)
+
+		nr, err := nar.NewReader(r)
+		if err != nil {
+			log.Printf("Error opening NAR: %v", err)
+			return
+		}
+
+		for {
+			header, err := nr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Printf("Error reading NAR entry: %v", err)
+				return
+			}
+
+			if target == matchPath || target == matchBoth {
+				if strings.Contains(header.Path, needle) {
+					out <- Match{Path: header.Path}
+					continue
+				}
+				if header.LinkTarget != "" && strings.Contains(header.LinkTarget, needle) {
+					out <- Match{Path: header.Path, Detail: header.LinkTarget}
+					continue
+				}
+			}
+
+			if (target == matchContents || target == matchBoth) && header.Type == nar.TypeRegular {
+				if maxFileSize > 0 && header.Size > maxFileSize {
+					continue
+				}
+
+				contents, err := io.ReadAll(nr)
+				if err != nil {
+					log.Printf("Error reading contents of %s: %v", header.Path, err)
+					return
+				}
+				if strings.Contains(string(contents), needle) {
+					out <- Match{Path: header.Path}
+				}
+			}
+		}
+	}()
+
+	return out
 }
 
 func main() {
 	flag.Parse()
 
-	var urlBase = nixCacheCDNBase
+	target := matchTarget(*match)
+	switch target {
+	case matchPath, matchContents, matchBoth:
+	default:
+		log.Fatalf("Invalid --match value %q: must be one of path, contents, both", *match)
+	}
+
+	fc, err := cache.New(*cacheDir, *cacheMaxAge, *cacheMaxSize)
+	if err != nil {
+		log.Fatalf("Error setting up cache: %v", err)
+	}
+
+	trustedKeys, err := binarycache.ParseTrustedKeys(trustedPublicKeys.values)
+	if err != nil {
+		log.Fatalf("Error parsing --trusted-public-keys: %v", err)
+	}
+
+	defaultSubstituter := binarycache.DefaultCDNSubstituter
 	paths, err := collectOutputPaths()
 	if err != nil {
 		log.Fatalf("Error collecting output paths: %v", err)
@@ -157,52 +399,149 @@ func main() {
 	if len(paths) == 0 {
 		log.Print("No paths to check, exiting")
 		os.Exit(1)
-	} else if len(paths) >= 50 {
+	} else if len(paths) >= 50 && len(substituters) == 0 {
 		log.Print("More than 50 paths to check, ensuring that we run co-located with the Nix cache...")
 		region, err := getAwsRegion()
 		if err != nil || region != nixCacheRegion {
 			log.Printf("To avoid unnecessary costs to the NixOS project, please run this program in the AWS %s region. Exiting.", nixCacheRegion)
 			os.Exit(1)
 		} else {
-			urlBase = nixCacheS3Base
+			defaultSubstituter = binarycache.DefaultS3Substituter
 		}
 	}
 
-	wg := &sync.WaitGroup{}
-	matches := make(chan string)
+	stores, err := resolveStores(defaultSubstituter, fc)
+	if err != nil {
+		log.Fatalf("Error setting up substituters: %v", err)
+	}
 
-	for _, p := range paths {
-		wg.Add(1)
-		go func(p string) {
-			defer wg.Done()
+	var excludeRe *regexp.Regexp
+	if *excludePattern != "" {
+		excludeRe, err = regexp.Compile(*excludePattern)
+		if err != nil {
+			log.Fatalf("Error parsing --exclude-pattern: %v", err)
+		}
+	}
 
-			hash := strings.Split(p, "-")[0]
-			narInfoURL := fmt.Sprintf("%s/%s.narinfo", urlBase, hash)
-			narURL, err := fetchNarInfo(narInfoURL)
-			if err != nil {
-				log.Printf("Error fetching NAR info for path %s: %v", p, err)
-				return
-			}
+	work := make(chan workItem)
+	results := make(chan string)
 
-			nar, err := fetchNar(narURL)
-			if err != nil {
-				log.Printf("Error fetching NAR for path %s: %v", p, err)
-				return
-			}
+	var itemWG sync.WaitGroup
+	var seen sync.Map
+	enqueue := func(item workItem) {
+		hash := strings.Split(item.Path, "-")[0]
+		if _, alreadySeen := seen.LoadOrStore(hash, struct{}{}); alreadySeen {
+			return
+		}
+		itemWG.Add(1)
+		go func() { work <- item }()
+	}
 
-			filesMatched := findNeedleInNar(*needle, nar)
-			for _, file := range filesMatched {
-				matches <- fmt.Sprintf("Found in %s: %s", p, file)
+	var workerWG sync.WaitGroup
+	for i := 0; i < *parallelism; i++ {
+		workerWG.Add(1)
+		go func() {
+			defer workerWG.Done()
+			for item := range work {
+				checkPath(fc, stores, trustedKeys, item, target, excludeRe, results, enqueue)
+				itemWG.Done()
 			}
-		}(p)
+		}()
+	}
+
+	for _, p := range paths {
+		enqueue(workItem{Path: p, Root: p})
 	}
 
 	go func() {
-		wg.Wait()
-		close(matches)
+		itemWG.Wait()
+		close(work)
+	}()
+
+	go func() {
+		workerWG.Wait()
+		close(results)
 	}()
 
-	for match := range matches {
-		fmt.Println(match)
+	for result := range results {
+		fmt.Println(result)
+	}
+}
+
+// checkPath fetches the narinfo and NAR for a single store path, sends any
+// --needle matches to results, and, in --closure mode, enqueues every
+// referenced path for the same treatment. Unless --no-check-signature is
+// passed, matches are withheld until the downloaded NAR's sha256 is checked
+// against the narinfo's NarHash, so a substituter can't swap the bytes
+// behind a validly signed narinfo.
+func checkPath(fc *cache.FileCache, stores []binarycache.Store, trustedKeys binarycache.TrustedKeys, item workItem, target matchTarget, excludeRe *regexp.Regexp, results chan<- string, enqueue func(workItem)) {
+	p := item.Path
+	hash := strings.Split(p, "-")[0]
+
+	info, store, err := fetchNarInfo(stores, hash)
+	if err != nil {
+		log.Printf("Error fetching NAR info for path %s: %v", p, err)
+		return
+	}
+	if info == nil {
+		return
+	}
+
+	if !*noCheckSignature && !binarycache.VerifySignature(info, trustedKeys) {
+		log.Printf("Refusing to grep %s: no valid signature from a trusted key (pass --no-check-signature to override)", p)
+		return
+	}
+
+	if *closure {
+		enqueueReferences(info, item, excludeRe, enqueue)
+	}
+
+	narReader, err := fetchNar(fc, store, info, hash)
+	if err != nil {
+		log.Printf("Error fetching NAR for path %s: %v", p, err)
+		return
+	}
+	defer narReader.Close()
+
+	hasher := sha256.New()
+	var found []string
+	for match := range scanNar(io.TeeReader(narReader, hasher), *needle, target, *maxFileSize) {
+		if item.Root == p {
+			found = append(found, fmt.Sprintf("Found in %s: %s", p, match))
+		} else {
+			found = append(found, fmt.Sprintf("Found in %s (pulled in by %s): %s", p, item.Root, match))
+		}
+	}
+
+	if !*noCheckSignature {
+		ok, err := binarycache.VerifyNarHash(hasher.Sum(nil), info.NarHash)
+		if err != nil {
+			log.Printf("Error verifying NAR hash for %s: %v", p, err)
+			return
+		}
+		if !ok {
+			log.Printf("Refusing to trust %s: downloaded NAR does not match its narinfo NarHash (pass --no-check-signature to override)", p)
+			return
+		}
+	}
+
+	for _, match := range found {
+		results <- match
+	}
+}
+
+// enqueueReferences queues every store path info.References points at for
+// grepping, carrying item's root and depth forward, honoring --max-depth
+// and --exclude-pattern.
+func enqueueReferences(info *binarycache.NarInfo, item workItem, excludeRe *regexp.Regexp, enqueue func(workItem)) {
+	if *maxDepth > 0 && item.Depth+1 > *maxDepth {
+		return
+	}
+
+	for _, ref := range info.References {
+		if excludeRe != nil && excludeRe.MatchString(ref) {
+			continue
+		}
+		enqueue(workItem{Path: ref, Root: item.Root, Depth: item.Depth + 1})
 	}
 }